@@ -0,0 +1,129 @@
+package objdb
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Client is the interface implemented by each pluggable objdb backend.
+// It captures the service-registry operations netmaster/netplugin use
+// to register, discover and watch peers, independent of which
+// coordination service backs them.
+type Client interface {
+	RegisterService(ServiceInfo) error
+	RegisterServiceWithContext(context.Context, ServiceInfo) error
+	DeregisterService(ServiceInfo) error
+	DeregisterServiceWithContext(context.Context, ServiceInfo) error
+	GetService(string) ([]ServiceInfo, error)
+	GetServiceWithContext(context.Context, string) ([]ServiceInfo, error)
+	WatchService(string, chan WatchServiceEvent, chan bool) error
+	WatchServiceWithContext(context.Context, string, chan WatchServiceEvent) error
+
+	// Campaign enters candidate into the leader election for
+	// serviceName and blocks until it becomes the active leader,
+	// returning a handle to monitor and eventually resign leadership.
+	Campaign(serviceName string, candidate ServiceInfo) (LeaderHandle, error)
+	// ObserveLeader streams the current leader's ServiceInfo on ch
+	// every time leadership changes for serviceName, until stop fires.
+	ObserveLeader(serviceName string, ch chan<- ServiceInfo, stop chan bool) error
+}
+
+// LeaderHandle is returned by Campaign and represents this candidate's
+// place in a leader election for as long as the process wants to stay
+// in the race.
+type LeaderHandle interface {
+	// IsLeader reports whether this candidate currently holds
+	// leadership.
+	IsLeader() bool
+	// LostCh is closed when leadership is lost, whether through Resign
+	// or the underlying session expiring (e.g. process death).
+	LostCh() <-chan struct{}
+	// Resign gives up leadership, if held, and stops campaigning.
+	Resign(ctx context.Context) error
+}
+
+// leaderState implements the IsLeader/LostCh bookkeeping shared by
+// every LeaderHandle. Resign and an involuntary loss (e.g. the
+// underlying session expiring) race to be the one that steps down;
+// whichever gets there first flips isLeader and closes lostCh exactly
+// once, so callers blocked on <-LostCh() are always woken, whether
+// leadership ended voluntarily or not.
+type leaderState struct {
+	isLeader int32 // atomic
+	lostCh   chan struct{}
+}
+
+func newLeaderState() *leaderState {
+	return &leaderState{isLeader: 1, lostCh: make(chan struct{})}
+}
+
+func (s *leaderState) IsLeader() bool {
+	return atomic.LoadInt32(&s.isLeader) == 1
+}
+
+func (s *leaderState) LostCh() <-chan struct{} {
+	return s.lostCh
+}
+
+// resign flips isLeader off and closes lostCh, running teardown (if
+// non-nil) in between. It is a no-op if leadership was already lost or
+// resigned.
+func (s *leaderState) resign(teardown func() error) error {
+	if !atomic.CompareAndSwapInt32(&s.isLeader, 1, 0) {
+		return nil
+	}
+
+	err := func() error {
+		if teardown != nil {
+			return teardown()
+		}
+		return nil
+	}()
+
+	close(s.lostCh)
+
+	return err
+}
+
+// lost marks leadership as involuntarily lost, closing lostCh unless
+// Resign already did so.
+func (s *leaderState) lost() {
+	if atomic.CompareAndSwapInt32(&s.isLeader, 1, 0) {
+		close(s.lostCh)
+	}
+}
+
+// NewClient builds a Client backed by the requested service registry.
+// Supported backends are "etcd" and "consul". The etcd backend passes
+// endpoints to its client library unchanged; the consul backend uses
+// only endpoints[0], as the agent address. This gives
+// operators who already run Consul a way to use netplugin without
+// deploying etcd, and gives us a seam for other backends (e.g. an
+// in-memory Client for tests).
+func NewClient(backend string, endpoints []string) (Client, error) {
+	switch backend {
+	case "etcd":
+		return newEtcdPlugin(endpoints)
+	case "consul":
+		return newConsulPlugin(endpoints)
+	default:
+		return nil, errors.New("unknown objdb backend: " + backend)
+	}
+}
+
+// newEtcdPlugin builds an etcd-backed Client.
+func newEtcdPlugin(endpoints []string) (Client, error) {
+	cli, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdPlugin{
+		client:    cli,
+		serviceDb: make(map[string]*serviceState),
+	}, nil
+}
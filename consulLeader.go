@@ -0,0 +1,127 @@
+package objdb
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const consulLeaderPrefix = consulServicePrefix + "leader/"
+
+// consulLeaderHandle implements LeaderHandle on top of a consul
+// distributed lock (session + KV acquire), consul's analog of etcd's
+// lease + transactional create.
+type consulLeaderHandle struct {
+	*leaderState
+
+	lock *consulapi.Lock
+}
+
+func (h *consulLeaderHandle) Resign(ctx context.Context) error {
+	return h.resign(func() error {
+		return h.lock.Unlock()
+	})
+}
+
+// Campaign enters candidate into the leader election for serviceName,
+// blocking until this candidate acquires the consul lock backing
+// contiv.io/service/leader/<serviceName>.
+func (self *consulPlugin) Campaign(serviceName string, candidate ServiceInfo) (LeaderHandle, error) {
+	jsonVal, err := json.Marshal(candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := self.client.LockOpts(&consulapi.LockOptions{
+		Key:   consulLeaderPrefix + serviceName,
+		Value: jsonVal,
+	})
+	if err != nil {
+		log.Errorf("Error creating election lock for %s, Err: %v", serviceName, err)
+		return nil, err
+	}
+
+	lostCh, err := lock.Lock(nil)
+	if err != nil {
+		log.Errorf("Error campaigning for %s leadership, Err: %v", serviceName, err)
+		return nil, err
+	}
+
+	log.Infof("%+v is now leader for %s", candidate, serviceName)
+
+	handle := &consulLeaderHandle{leaderState: newLeaderState(), lock: lock}
+
+	go func() {
+		<-lostCh
+		handle.lost()
+	}()
+
+	return handle, nil
+}
+
+// ObserveLeader streams the current leader's ServiceInfo on ch every
+// time leadership changes for serviceName, until stop fires. It polls
+// the leader key with consul blocking queries, consul's equivalent of
+// etcd's Election.Observe. On a Get error it backs off exponentially
+// (capped at watchMaxBackoff, same as etcd's and consul's own watch
+// loops) instead of busy-spinning against an unreachable agent.
+func (self *consulPlugin) ObserveLeader(serviceName string, ch chan<- ServiceInfo, stop chan bool) error {
+	keyName := consulLeaderPrefix + serviceName
+
+	go func() {
+		var waitIndex uint64
+		backoff := time.Second
+
+		for {
+			select {
+			case stopReq := <-stop:
+				if stopReq {
+					return
+				}
+			default:
+			}
+
+			pair, meta, err := self.client.KV().Get(keyName, &consulapi.QueryOptions{
+				WaitIndex: waitIndex,
+			})
+			if err != nil {
+				log.Errorf("Error observing leader for %s, retrying in %v, Err: %v", serviceName, backoff, err)
+
+				select {
+				case <-time.After(backoff):
+				case stopReq := <-stop:
+					if stopReq {
+						return
+					}
+				}
+
+				if backoff *= 2; backoff > watchMaxBackoff {
+					backoff = watchMaxBackoff
+				}
+
+				continue
+			}
+
+			backoff = time.Second
+			waitIndex = meta.LastIndex
+
+			if pair == nil {
+				continue
+			}
+
+			var leader ServiceInfo
+			if err := json.Unmarshal(pair.Value, &leader); err != nil {
+				log.Errorf("Error parsing leader value for %s, Err %v", serviceName, err)
+				continue
+			}
+
+			ch <- leader
+		}
+	}()
+
+	return nil
+}
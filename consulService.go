@@ -0,0 +1,329 @@
+package objdb
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	consulapi "github.com/hashicorp/consul/api"
+	consulwatch "github.com/hashicorp/consul/watch"
+)
+
+const consulServicePrefix = "contiv.io/service/"
+
+// consulServiceState mirrors serviceState for the consul backend: the
+// session backing the current registration, so Deregister can destroy
+// it.
+type consulServiceState struct {
+	ServiceName string
+	HostAddr    string
+	Port        int
+
+	sessionID string
+	stopChan  chan bool
+}
+
+// consulPlugin implements Client on top of a HashiCorp Consul agent. It
+// registers services using a session TTL + KV acquire (consul's analog
+// of an etcd lease), and implements WatchService with the consul watch
+// package's keyprefix plan, which runs blocking queries against the
+// agent under the hood.
+type consulPlugin struct {
+	client    *consulapi.Client
+	serviceDb map[string]*consulServiceState
+}
+
+// newConsulPlugin builds a consul-backed Client. endpoints[0], if
+// present, overrides the default local agent address.
+func newConsulPlugin(endpoints []string) (Client, error) {
+	cfg := consulapi.DefaultConfig()
+	if len(endpoints) > 0 {
+		cfg.Address = endpoints[0]
+	}
+
+	cli, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &consulPlugin{
+		client:    cli,
+		serviceDb: make(map[string]*consulServiceState),
+	}, nil
+}
+
+// RegisterService registers a service, see RegisterServiceWithContext.
+func (self *consulPlugin) RegisterService(serviceInfo ServiceInfo) error {
+	return self.RegisterServiceWithContext(context.Background(), serviceInfo)
+}
+
+// RegisterServiceWithContext registers a service under a 60sec session
+// ttl. A background goroutine renews the session periodically; if the
+// agent loses the session (e.g. it restarts), Consul releases the key
+// on its own, matching the etcd lease-expiry behavior.
+func (self *consulPlugin) RegisterServiceWithContext(ctx context.Context, serviceInfo ServiceInfo) error {
+	keyName := consulServicePrefix + serviceInfo.ServiceName + "/" +
+		serviceInfo.HostAddr + ":" + strconv.Itoa(serviceInfo.Port)
+
+	log.Infof("Registering service key: %s, value: %+v", keyName, serviceInfo)
+
+	jsonVal, err := json.Marshal(serviceInfo)
+	if err != nil {
+		log.Errorf("Json conversion error. Err %v", err)
+		return err
+	}
+
+	session, _, err := self.client.Session().Create(&consulapi.SessionEntry{
+		TTL:      "60s",
+		Behavior: consulapi.SessionBehaviorDelete,
+	}, nil)
+	if err != nil {
+		log.Errorf("Error creating consul session for key %s, Err: %v", keyName, err)
+		return err
+	}
+
+	ok, _, err := self.client.KV().Acquire(&consulapi.KVPair{
+		Key:     keyName,
+		Value:   jsonVal,
+		Session: session,
+	}, nil)
+	if err != nil {
+		log.Errorf("Error setting key %s, Err: %v", keyName, err)
+		return err
+	}
+	if !ok {
+		return errors.New("failed to acquire consul key " + keyName)
+	}
+
+	stopChan := make(chan bool, 1)
+	doneCh := make(chan struct{})
+
+	go self.client.Session().RenewPeriodic("50s", session, nil, doneCh)
+	go func() {
+		<-stopChan
+		close(doneCh)
+	}()
+
+	self.serviceDb[keyName] = &consulServiceState{
+		ServiceName: serviceInfo.ServiceName,
+		HostAddr:    serviceInfo.HostAddr,
+		Port:        serviceInfo.Port,
+		sessionID:   session,
+		stopChan:    stopChan,
+	}
+
+	return nil
+}
+
+// GetService lists all end points for a service, see
+// GetServiceWithContext.
+func (self *consulPlugin) GetService(name string) ([]ServiceInfo, error) {
+	return self.GetServiceWithContext(context.Background(), name)
+}
+
+// GetServiceWithContext lists all end points for a service. ctx is
+// currently unused: the consul API client does not accept one, unlike
+// clientv3.
+func (self *consulPlugin) GetServiceWithContext(ctx context.Context, name string) ([]ServiceInfo, error) {
+	keyName := consulServicePrefix + name + "/"
+
+	pairs, _, err := self.client.KV().List(keyName, nil)
+	if err != nil {
+		log.Errorf("Error getting key %s. Err: %v", keyName, err)
+		return nil, err
+	}
+
+	srvcList := make([]ServiceInfo, 0)
+
+	for _, pair := range pairs {
+		var respSrvc ServiceInfo
+		if err := json.Unmarshal(pair.Value, &respSrvc); err != nil {
+			log.Errorf("Error parsing object %s, Err %v", string(pair.Value), err)
+			return nil, err
+		}
+
+		srvcList = append(srvcList, respSrvc)
+	}
+
+	return srvcList, nil
+}
+
+// WatchService watches for a service, see WatchServiceWithContext.
+// stopCh is kept for backward compatibility: sending true on it cancels
+// the derived context.
+func (self *consulPlugin) WatchService(name string,
+	eventCh chan WatchServiceEvent, stopCh chan bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for {
+			if stopReq := <-stopCh; stopReq {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return self.WatchServiceWithContext(ctx, name, eventCh)
+}
+
+// WatchServiceWithContext watches for a service using a consul
+// keyprefix watch plan. Each invocation of the plan's handler carries
+// the full current key set for the prefix (consul's blocking queries
+// replay current state on every change), so it is diffed against the
+// last known endpoint set to synthesize Add/Del events, the same
+// resync strategy the etcd backend uses. If the plan itself ever exits
+// with an error (agent restart, network blip), it is restarted with
+// exponential backoff instead of leaving the watch dead, so both
+// backends honor the same "survive transient blips" contract.
+func (self *consulPlugin) WatchServiceWithContext(ctx context.Context, name string,
+	eventCh chan WatchServiceEvent) error {
+	keyName := consulServicePrefix + name + "/"
+
+	log.Infof("Watching for service: %s", keyName)
+
+	go self.watchServiceLoop(ctx, keyName, eventCh)
+
+	return nil
+}
+
+// watchServiceLoop runs a watch plan for keyName until ctx is
+// cancelled, restarting it with backoff (capped at watchMaxBackoff, the
+// same cap the etcd backend uses) whenever it exits with an error.
+// endpoints mirrors the last known state of keyName's prefix so each
+// restart resumes diffing from accurate state instead of re-announcing
+// everything as newly added.
+func (self *consulPlugin) watchServiceLoop(ctx context.Context, keyName string, eventCh chan WatchServiceEvent) {
+	endpoints := make(map[string]ServiceInfo)
+	backoff := time.Second
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := self.runServiceWatch(ctx, keyName, eventCh, endpoints)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Errorf("Watch plan for %s exited with error, retrying in %v. Err: %v", keyName, backoff, err)
+			eventCh <- WatchServiceEvent{EventType: WatchServiceEventError}
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+
+			if backoff *= 2; backoff > watchMaxBackoff {
+				backoff = watchMaxBackoff
+			}
+
+			continue
+		}
+
+		backoff = time.Second
+	}
+}
+
+// runServiceWatch builds and runs a single consul keyprefix watch plan
+// for keyName, blocking until it exits (error, ctx cancellation, or the
+// caller stops it).
+func (self *consulPlugin) runServiceWatch(ctx context.Context, keyName string,
+	eventCh chan WatchServiceEvent, endpoints map[string]ServiceInfo) error {
+	plan, err := consulwatch.Parse(map[string]interface{}{
+		"type":   "keyprefix",
+		"prefix": keyName,
+	})
+	if err != nil {
+		return err
+	}
+
+	plan.Handler = func(idx uint64, raw interface{}) {
+		pairs, ok := raw.(consulapi.KVPairs)
+		if !ok {
+			return
+		}
+
+		current := make(map[string]ServiceInfo)
+		for _, pair := range pairs {
+			var srvInfo ServiceInfo
+			if err := json.Unmarshal(pair.Value, &srvInfo); err != nil {
+				log.Errorf("Error parsing object %s, Err %v", string(pair.Value), err)
+				continue
+			}
+
+			current[pair.Key] = srvInfo
+		}
+
+		for key, srvInfo := range endpoints {
+			if _, ok := current[key]; !ok {
+				log.Infof("Sending service del event: %+v", srvInfo)
+				eventCh <- WatchServiceEvent{EventType: WatchServiceEventDel, ServiceInfo: srvInfo}
+			}
+		}
+
+		for key, srvInfo := range current {
+			if prev, ok := endpoints[key]; !ok || prev != srvInfo {
+				log.Infof("Sending service add event: %+v", srvInfo)
+				eventCh <- WatchServiceEvent{EventType: WatchServiceEventAdd, ServiceInfo: srvInfo}
+			}
+		}
+
+		for key := range endpoints {
+			delete(endpoints, key)
+		}
+		for key, srvInfo := range current {
+			endpoints[key] = srvInfo
+		}
+	}
+
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- plan.RunWithClientAndHclog(self.client, nil)
+	}()
+
+	select {
+	case err := <-runErrCh:
+		return err
+	case <-ctx.Done():
+		plan.Stop()
+		<-runErrCh
+		return nil
+	}
+}
+
+// DeregisterService deregisters a service, see
+// DeregisterServiceWithContext.
+func (self *consulPlugin) DeregisterService(serviceInfo ServiceInfo) error {
+	return self.DeregisterServiceWithContext(context.Background(), serviceInfo)
+}
+
+// DeregisterServiceWithContext stops the session-renewal goroutine and
+// destroys the session, which releases and removes the key from consul.
+func (self *consulPlugin) DeregisterServiceWithContext(ctx context.Context, serviceInfo ServiceInfo) error {
+	keyName := consulServicePrefix + serviceInfo.ServiceName + "/" +
+		serviceInfo.HostAddr + ":" + strconv.Itoa(serviceInfo.Port)
+
+	srvState := self.serviceDb[keyName]
+	if srvState == nil {
+		log.Errorf("Could not find the service in db %s", keyName)
+		return errors.New("Service not found")
+	}
+
+	srvState.stopChan <- true
+	delete(self.serviceDb, keyName)
+
+	if _, err := self.client.Session().Destroy(srvState.sessionID, nil); err != nil {
+		log.Errorf("Error destroying session for key %s. Err: %v", keyName, err)
+		return err
+	}
+
+	return nil
+}
@@ -5,28 +5,58 @@ import (
 	"errors"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/contiv/go-etcd/etcd"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/etcd/clientv3"
 )
 
 const SERVICE_TTL = 60
 
+// serviceDbMu guards self.serviceDb (across every etcdPlugin, since it's
+// a single package-level lock) and the leaseID field of every
+// serviceState in it: RegisterServiceWithContext, DeregisterServiceWithContext
+// and the background reregisterService goroutine all touch it
+// concurrently.
+var serviceDbMu sync.Mutex
+
 // Service state
 type serviceState struct {
 	ServiceName string // Name of the service
 	HostAddr    string // Host name or IP address where its running
 	Port        int    // Port number where its listening
 
-	// Channel to stop ttl refresh
-	stopChan chan bool
+	// Lease backing the current registration, so Deregister can revoke
+	// it. Guarded by serviceDbMu.
+	leaseID clientv3.LeaseID
+
+	// stopCtx/stopCancel span every reconnect "generation" of the
+	// keepalive/reregister loop below. Cancelling stopCtx (as opposed
+	// to sending once on a channel) is what lets Deregister stop
+	// whichever generation happens to be running at the time, instead
+	// of racing a backoff retry that's about to start a new one.
+	stopCtx    context.Context
+	stopCancel context.CancelFunc
 }
 
-// Register a service
-// Service is registered with a ttl for 60sec and a goroutine is created
-// to refresh the ttl.
+// RegisterService registers a service, see RegisterServiceWithContext.
+// It blocks with no deadline; prefer RegisterServiceWithContext for new
+// callers.
 func (self *etcdPlugin) RegisterService(serviceInfo ServiceInfo) error {
+	return self.RegisterServiceWithContext(context.Background(), serviceInfo)
+}
+
+// RegisterServiceWithContext registers a service.
+// Service is registered under a lease with a 60sec ttl. A background
+// goroutine consumes the lease's KeepAlive stream and re-registers the
+// service (re-Grant + re-Put) if the etcd session is ever lost, so a
+// transient etcd outage doesn't leave the service permanently
+// deregistered. ctx only bounds the initial Grant/Put; it is not held
+// for the lifetime of the registration.
+func (self *etcdPlugin) RegisterServiceWithContext(ctx context.Context, serviceInfo ServiceInfo) error {
 	keyName := "/contiv.io/service/" + serviceInfo.ServiceName + "/" +
 		serviceInfo.HostAddr + ":" + strconv.Itoa(serviceInfo.Port)
 
@@ -39,58 +69,172 @@ func (self *etcdPlugin) RegisterService(serviceInfo ServiceInfo) error {
 		return err
 	}
 
-	// Set it via etcd client
-	_, err = self.client.Set(keyName, string(jsonVal[:]), SERVICE_TTL)
+	stopCtx, stopCancel := context.WithCancel(context.Background())
+
+	leaseID, err := self.putServiceWithLease(ctx, keyName, string(jsonVal[:]), stopCtx)
 	if err != nil {
-		log.Errorf("Error setting key %s, Err: %v", keyName, err)
+		stopCancel()
 		return err
 	}
 
-	// Run refresh in background
-	stopChan := make(chan bool, 1)
-	go refreshService(self.client, keyName, string(jsonVal[:]), stopChan)
-
 	// Store it in DB
+	serviceDbMu.Lock()
 	self.serviceDb[keyName] = &serviceState{
 		ServiceName: serviceInfo.ServiceName,
 		HostAddr:    serviceInfo.HostAddr,
 		Port:        serviceInfo.Port,
-		stopChan:    stopChan,
+		leaseID:     leaseID,
+		stopCtx:     stopCtx,
+		stopCancel:  stopCancel,
 	}
+	serviceDbMu.Unlock()
 
 	return nil
 }
 
-// List all end points for a service
-func (self *etcdPlugin) GetService(name string) ([]ServiceInfo, error) {
-	keyName := "/contiv.io/service/" + name + "/"
+// putServiceWithLease grants a SERVICE_TTL lease, puts keyName/keyVal under
+// it, and starts a goroutine that watches the lease's KeepAlive channel,
+// re-granting and re-putting the key whenever the session is lost. ctx
+// bounds the Grant/Put round trip only. stopCtx spans every reconnect
+// generation of the registration; if it's already cancelled by the time
+// the lease/key are in place (Deregister raced a retry), the fresh lease
+// is revoked immediately instead of being left running under an owner
+// that's no longer tracking it.
+func (self *etcdPlugin) putServiceWithLease(ctx context.Context, keyName, keyVal string, stopCtx context.Context) (clientv3.LeaseID, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	lease, err := self.client.Grant(ctx, SERVICE_TTL)
+	if err != nil {
+		log.Errorf("Error granting lease for key %s, Err: %v", keyName, err)
+		return 0, err
+	}
+
+	if _, err := self.client.Put(ctx, keyName, keyVal, clientv3.WithLease(lease.ID)); err != nil {
+		log.Errorf("Error setting key %s, Err: %v", keyName, err)
+		return 0, err
+	}
 
-	// Get the object from etcd client
-	resp, err := self.client.Get(keyName, true, true)
+	keepAliveCh, err := self.client.KeepAlive(context.Background(), lease.ID)
 	if err != nil {
-		if strings.Contains(err.Error(), "Key not found") {
-			return nil, nil
-		} else {
-			log.Errorf("Error getting key %s. Err: %v", keyName, err)
-			return nil, err
+		log.Errorf("Error starting keepalive for key %s, Err: %v", keyName, err)
+		return 0, err
+	}
+
+	if stopCtx.Err() != nil {
+		revokeCtx, revokeCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer revokeCancel()
+
+		if _, err := self.client.Revoke(revokeCtx, lease.ID); err != nil {
+			log.Errorf("Error revoking lease for key %s after deregister raced registration, Err: %v", keyName, err)
+		}
+
+		return 0, stopCtx.Err()
+	}
+
+	go keepServiceAlive(self, keyName, keyVal, keepAliveCh, stopCtx)
+
+	return lease.ID, nil
+}
+
+// keepServiceAlive drains the lease's KeepAlive responses. If the channel
+// is closed (session lost, e.g. etcd restart or network blip), it keeps
+// retrying to re-register the service under a fresh lease, backing off
+// exponentially (capped at watchMaxBackoff, the same cap watchServiceLoop
+// uses) until it succeeds or stopCtx is cancelled. A transient etcd
+// outage is exactly when the first retry is likely to fail too, so a
+// single attempt isn't enough to honor "never leave the service
+// permanently deregistered".
+func keepServiceAlive(self *etcdPlugin, keyName, keyVal string, keepAliveCh <-chan *clientv3.LeaseKeepAliveResponse, stopCtx context.Context) {
+	for {
+		select {
+		case _, ok := <-keepAliveCh:
+			if !ok {
+				log.Errorf("Lost etcd session for key %s, re-registering", keyName)
+				reregisterService(self, keyName, keyVal, stopCtx)
+				return
+			}
+		case <-stopCtx.Done():
+			log.Infof("Stop refreshing key: %s", keyName)
+			return
+		}
+	}
+}
+
+// reregisterService retries putServiceWithLease with exponential backoff
+// until it succeeds or stopCtx is cancelled. stopCtx is shared by every
+// reconnect generation for this registration (set once in
+// RegisterServiceWithContext), so a Deregister racing an in-flight retry
+// always reaches whichever generation is actually running, instead of
+// being consumed by a stopChan that a previous, already-exited generation
+// owned.
+func reregisterService(self *etcdPlugin, keyName, keyVal string, stopCtx context.Context) {
+	backoff := time.Second
+
+	for {
+		if stopCtx.Err() != nil {
+			return
+		}
+
+		leaseID, err := self.putServiceWithLease(context.Background(), keyName, keyVal, stopCtx)
+		if err == nil {
+			serviceDbMu.Lock()
+			if srvState, ok := self.serviceDb[keyName]; ok {
+				srvState.leaseID = leaseID
+			}
+			serviceDbMu.Unlock()
+
+			return
 		}
 
+		if stopCtx.Err() != nil {
+			return
+		}
+
+		log.Errorf("Error re-registering key %s, retrying in %v, Err: %v", keyName, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-stopCtx.Done():
+			log.Infof("Stop retrying registration for key: %s", keyName)
+			return
+		}
+
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
 	}
+}
+
+// GetService lists all end points for a service, see
+// GetServiceWithContext. It blocks with no deadline; prefer
+// GetServiceWithContext for new callers.
+func (self *etcdPlugin) GetService(name string) ([]ServiceInfo, error) {
+	return self.GetServiceWithContext(context.Background(), name)
+}
+
+// GetServiceWithContext lists all end points for a service.
+func (self *etcdPlugin) GetServiceWithContext(ctx context.Context, name string) ([]ServiceInfo, error) {
+	keyName := "/contiv.io/service/" + name + "/"
 
-	if !resp.Node.Dir {
-		log.Errorf("Err. Response is not a directory: %+v", resp.Node)
-		return nil, errors.New("Invalid Response from etcd")
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	resp, err := self.client.Get(ctx, keyName, clientv3.WithPrefix())
+	if err != nil {
+		log.Errorf("Error getting key %s. Err: %v", keyName, err)
+		return nil, err
 	}
 
 	srvcList := make([]ServiceInfo, 0)
 
-	// Parse each node in the directory
-	for _, node := range resp.Node.Nodes {
+	// Parse each key under the service prefix
+	for _, kv := range resp.Kvs {
 		var respSrvc ServiceInfo
 		// Parse JSON response
-		err = json.Unmarshal([]byte(node.Value), &respSrvc)
+		err = json.Unmarshal(kv.Value, &respSrvc)
 		if err != nil {
-			log.Errorf("Error parsing object %s, Err %v", node.Value, err)
+			log.Errorf("Error parsing object %s, Err %v", string(kv.Value), err)
 			return nil, err
 		}
 
@@ -100,55 +244,213 @@ func (self *etcdPlugin) GetService(name string) ([]ServiceInfo, error) {
 	return srvcList, nil
 }
 
-func (self *etcdPlugin) getCurrentIndex(key string) (uint64, error) {
-	// Get the object from etcd client
-	resp, err := self.client.Get(key, true, false)
-	if err != nil {
-		return 0, err
-	}
+// WatchService watches for a service, see WatchServiceWithContext. stopCh
+// is kept for backward compatibility: sending true on it cancels the
+// derived context. New callers should use WatchServiceWithContext
+// directly and cancel via ctx.
+func (self *etcdPlugin) WatchService(name string,
+	eventCh chan WatchServiceEvent, stopCh chan bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for {
+			if stopReq := <-stopCh; stopReq {
+				cancel()
+				return
+			}
+		}
+	}()
 
-	return resp.Node.ModifiedIndex, nil
+	return self.WatchServiceWithContext(ctx, name, eventCh)
 }
 
-// Watch for a service
-func (self *etcdPlugin) WatchService(name string,
-	eventCh chan WatchServiceEvent, stopCh chan bool) error {
+const (
+	// watchLifetime bounds how long a single underlying watch is kept
+	// open before it is rotated, to avoid the silent-stale-watch
+	// problem on long lived connections.
+	watchLifetime = time.Minute
+
+	// watchMaxBackoff caps the exponential backoff between resync
+	// attempts after a watch error or compaction.
+	watchMaxBackoff = 30 * time.Second
+)
+
+// WatchServiceWithContext watches for a service. The watch's lifecycle is
+// derived from ctx.Done(), so callers cancel it by cancelling ctx.
+//
+// The watch is resilient to etcd restarts, compactions and network
+// blips: it lists the current endpoints, emits synthetic Add events for
+// each of them so new subscribers see current state, then watches from
+// the list's revision. On any watch error it backs off exponentially
+// (capped at watchMaxBackoff) and re-lists, diffing against a locally
+// cached endpoint set so consumers only see the Add/Del events for what
+// actually changed. Each underlying watch is also rotated after
+// watchLifetime regardless of errors.
+func (self *etcdPlugin) WatchServiceWithContext(ctx context.Context, name string,
+	eventCh chan WatchServiceEvent) error {
 	keyName := "/contiv.io/service/" + name + "/"
 
-	// Create channels
-	watchCh := make(chan *etcd.Response, 1)
-	watchStopCh := make(chan bool, 1)
+	log.Infof("Watching for service: %s", keyName)
 
-	// Start the watch thread
-	go func() {
-		// Watch from current index to force a read of the initial state
-		watchIndex, err := self.getCurrentIndex(keyName)
-		if (err != nil) {
-			log.Fatalf("Unable to watch service key: %s - %v", keyName,
-				err)
+	go self.watchServiceLoop(ctx, keyName, eventCh)
+
+	return nil
+}
+
+// watchServiceLoop drives the resync + bounded-watch cycle until ctx is
+// cancelled. endpoints mirrors the last known state of keyName's prefix
+// so resyncs can be diffed down to the actual Add/Del delta.
+//
+// Both sources of watch failure - resyncService's List call and
+// runServiceWatch's Watch stream (compaction, Canceled, stream closed) -
+// share the same handling: log, emit WatchServiceEventError so
+// consumers know not to trust the last-seen state, and back off
+// exponentially (capped at watchMaxBackoff) before retrying, so a
+// persistently failing watch doesn't hammer etcd with an unthrottled
+// List+Watch cycle.
+func (self *etcdPlugin) watchServiceLoop(ctx context.Context, keyName string, eventCh chan WatchServiceEvent) {
+	endpoints := make(map[string]ServiceInfo)
+	backoff := time.Second
+
+	for {
+		if ctx.Err() != nil {
+			return
 		}
 
-		log.Infof("Watching for service: %s at index %v", keyName, watchIndex)
-		// Start the watch
-		_, err = self.client.Watch(keyName, watchIndex, true, watchCh, watchStopCh)
-		if (err != nil) && (err != etcd.ErrWatchStoppedByUser) {
-			log.Errorf("Error watching service %s. Err: %v", keyName, err)
+		rev, err := self.resyncService(ctx, keyName, eventCh, endpoints)
+		if err != nil {
+			log.Errorf("Error resyncing service %s. Err: %v", keyName, err)
 
-			// Emit the event
-			eventCh <- WatchServiceEvent{EventType: WatchServiceEventError}
+			if !self.backoffWatchError(ctx, eventCh, &backoff) {
+				return
+			}
+
+			continue
 		}
-		log.Infof("Watch thread exiting..")
-	}()
 
-	// handle messages from watch service
-	go func() {
-		for {
-			select {
-			case watchResp := <-watchCh:
-				log.Debugf("Received event %#v\n Node: %#v", watchResp, watchResp.Node)
+		backoff = time.Second
+
+		// Bound the underlying watch's lifetime and rotate it even if
+		// no error occurs.
+		watchCtx, watchCancel := context.WithTimeout(ctx, watchLifetime)
+		err = self.runServiceWatch(watchCtx, keyName, rev+1, eventCh, endpoints)
+		watchCancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Errorf("Watch on %s ended with error, resyncing. Err: %v", keyName, err)
+
+			if !self.backoffWatchError(ctx, eventCh, &backoff) {
+				return
+			}
+
+			continue
+		}
 
+		log.Infof("Rotating watch on %s", keyName)
+		backoff = time.Second
+	}
+}
+
+// backoffWatchError emits a WatchServiceEventError and sleeps for
+// backoff (doubling it, capped at watchMaxBackoff) before returning, so
+// every watch error source goes through the same throttling regardless
+// of whether it came from the resync List or the Watch stream. It
+// returns false if ctx was cancelled during the wait, in which case the
+// caller should stop.
+func (self *etcdPlugin) backoffWatchError(ctx context.Context, eventCh chan WatchServiceEvent, backoff *time.Duration) bool {
+	eventCh <- WatchServiceEvent{EventType: WatchServiceEventError}
+
+	select {
+	case <-time.After(*backoff):
+	case <-ctx.Done():
+		return false
+	}
+
+	if *backoff *= 2; *backoff > watchMaxBackoff {
+		*backoff = watchMaxBackoff
+	}
+
+	return true
+}
+
+// resyncService lists the current endpoints under keyName, diffs them
+// against the cached endpoints, emits Add/Del events for the
+// difference, updates endpoints in place, and returns the revision of
+// the listing (so the caller can watch from rev+1).
+func (self *etcdPlugin) resyncService(ctx context.Context, keyName string,
+	eventCh chan WatchServiceEvent, endpoints map[string]ServiceInfo) (int64, error) {
+	getCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	resp, err := self.client.Get(getCtx, keyName, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	current := make(map[string]ServiceInfo)
+	for _, kv := range resp.Kvs {
+		var srvInfo ServiceInfo
+		if err := json.Unmarshal(kv.Value, &srvInfo); err != nil {
+			log.Errorf("Error parsing object %s, Err %v", string(kv.Value), err)
+			continue
+		}
+
+		current[string(kv.Key)] = srvInfo
+	}
+
+	// Emit Del for anything that disappeared, Add for anything new or
+	// changed since the last snapshot.
+	for key, srvInfo := range endpoints {
+		if _, ok := current[key]; !ok {
+			log.Infof("Sending service del event: %+v", srvInfo)
+			eventCh <- WatchServiceEvent{EventType: WatchServiceEventDel, ServiceInfo: srvInfo}
+		}
+	}
+
+	for key, srvInfo := range current {
+		if prev, ok := endpoints[key]; !ok || prev != srvInfo {
+			log.Infof("Sending service add event: %+v", srvInfo)
+			eventCh <- WatchServiceEvent{EventType: WatchServiceEventAdd, ServiceInfo: srvInfo}
+		}
+	}
+
+	for key := range endpoints {
+		delete(endpoints, key)
+	}
+	for key, srvInfo := range current {
+		endpoints[key] = srvInfo
+	}
+
+	return resp.Header.Revision, nil
+}
+
+// runServiceWatch watches keyName's prefix starting at rev until
+// watchCtx is done, an error/compaction is hit, or the channel closes.
+// It keeps endpoints up to date as events arrive so a subsequent resync
+// diffs against accurate state.
+func (self *etcdPlugin) runServiceWatch(watchCtx context.Context, keyName string, rev int64,
+	eventCh chan WatchServiceEvent, endpoints map[string]ServiceInfo) error {
+	watchCh := self.client.Watch(watchCtx, keyName, clientv3.WithPrefix(),
+		clientv3.WithPrevKV(), clientv3.WithRev(rev))
+
+	for {
+		select {
+		case watchResp, ok := <-watchCh:
+			if !ok {
+				return errors.New("watch channel closed")
+			}
+
+			if err := watchResp.Err(); err != nil {
+				return err
+			}
+
+			for _, ev := range watchResp.Events {
 				// derive service info from key
-				srvKey := strings.TrimPrefix(watchResp.Node.Key, "/contiv.io/service/")
+				srvKey := strings.TrimPrefix(string(ev.Kv.Key), "/contiv.io/service/")
 				srvName := strings.Split(srvKey, "/")[0]
 				hostInfo := strings.Split(srvKey, "/")[1]
 				hostAddr := strings.Split(hostInfo, ":")[0]
@@ -161,84 +463,69 @@ func (self *etcdPlugin) WatchService(name string,
 					Port:        portNum,
 				}
 
-				// We ignore all events except Set/Delete/Expire
-				// Note that Set event doesnt exactly mean new service end point.
-				// If a service restarts and re-registers before it expired, we'll
-				// receive set again. receivers need to handle this case
-				if watchResp.Action == "set" {
+				if ev.IsCreate() || ev.IsModify() {
 					log.Infof("Sending service add event: %+v", srvInfo)
-					// Send Add event
+					endpoints[string(ev.Kv.Key)] = srvInfo
 					eventCh <- WatchServiceEvent{
 						EventType:   WatchServiceEventAdd,
 						ServiceInfo: srvInfo,
 					}
-				} else if (watchResp.Action == "delete") ||
-					(watchResp.Action == "expire") {
-
+				} else if ev.Type == clientv3.EventTypeDelete {
 					log.Infof("Sending service del event: %+v", srvInfo)
-
-					// Send Delete event
+					delete(endpoints, string(ev.Kv.Key))
 					eventCh <- WatchServiceEvent{
 						EventType:   WatchServiceEventDel,
 						ServiceInfo: srvInfo,
 					}
 				}
-			case stopReq := <-stopCh:
-				if stopReq {
-					// Stop watch and return
-					log.Infof("Stopping watch on %s", keyName)
-					watchStopCh <- true
-					return
-				}
 			}
+		case <-watchCtx.Done():
+			return nil
 		}
-	}()
-
-	return nil
+	}
 }
 
-// Deregister a service
-// This removes the service from the registry and stops the refresh groutine
+// DeregisterService deregisters a service, see
+// DeregisterServiceWithContext. It blocks with no deadline; prefer
+// DeregisterServiceWithContext for new callers.
 func (self *etcdPlugin) DeregisterService(serviceInfo ServiceInfo) error {
+	return self.DeregisterServiceWithContext(context.Background(), serviceInfo)
+}
+
+// DeregisterServiceWithContext stops the keep-alive/reregister goroutine
+// and revokes the service's lease, which removes the key from etcd in
+// one round trip.
+func (self *etcdPlugin) DeregisterServiceWithContext(ctx context.Context, serviceInfo ServiceInfo) error {
 	keyName := "/contiv.io/service/" + serviceInfo.ServiceName + "/" +
 		serviceInfo.HostAddr + ":" + strconv.Itoa(serviceInfo.Port)
 
 	// Find it in the database
+	serviceDbMu.Lock()
 	srvState := self.serviceDb[keyName]
 	if srvState == nil {
+		serviceDbMu.Unlock()
 		log.Errorf("Could not find the service in db %s", keyName)
 		return errors.New("Service not found")
 	}
-
-	// stop the refresh thread and delete service
-	srvState.stopChan <- true
 	delete(self.serviceDb, keyName)
+	leaseID := srvState.leaseID
+	serviceDbMu.Unlock()
+
+	// Cancelling stopCtx reaches whatever generation of
+	// keepServiceAlive/reregisterService is currently running, however
+	// many reconnects have happened since registration.
+	srvState.stopCancel()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
-	// Delete the service instance
-	_, err := self.client.Delete(keyName, false)
+	// Revoking the lease drops the key immediately, instead of waiting
+	// for the ttl to expire.
+	_, err := self.client.Revoke(ctx, leaseID)
 	if err != nil {
-		log.Errorf("Error getting key %s. Err: %v", keyName, err)
+		log.Errorf("Error revoking lease for key %s. Err: %v", keyName, err)
 		return err
 	}
 
 	return nil
 }
-
-// Keep refreshing the service every 30sec
-func refreshService(client *etcd.Client, keyName string, keyVal string, stopChan chan bool) {
-	for {
-		select {
-		case <-time.After(time.Second * time.Duration(SERVICE_TTL/3)):
-			log.Debugf("Refreshing key: %s", keyName)
-
-			_, err := client.Update(keyName, keyVal, SERVICE_TTL)
-			if err != nil {
-				log.Errorf("Error updating key %s, Err: %v", keyName, err)
-			}
-
-		case <-stopChan:
-			log.Infof("Stop refreshing key: %s", keyName)
-			return
-		}
-	}
-}
@@ -0,0 +1,125 @@
+package objdb
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+const leaderElectionTTL = SERVICE_TTL
+
+// etcdLeaderHandle implements LeaderHandle on top of an etcd
+// concurrency.Session/Election pair: a lease-backed session plus a
+// transactional create on /contiv.io/leader/<service>, where the lowest
+// revision holder is leader. Resigning, or the session's lease
+// expiring on process death, hands leadership to the next candidate.
+type etcdLeaderHandle struct {
+	*leaderState
+
+	session  *concurrency.Session
+	election *concurrency.Election
+}
+
+func (h *etcdLeaderHandle) Resign(ctx context.Context) error {
+	return h.resign(func() error {
+		err := h.election.Resign(ctx)
+		h.session.Close()
+		return err
+	})
+}
+
+// Campaign enters candidate into the leader election for serviceName,
+// reusing the etcd connection the service registry already holds. It
+// blocks until this candidate becomes leader, then returns a
+// LeaderHandle the caller can use to check status, wait for an
+// involuntary loss, and eventually Resign.
+func (self *etcdPlugin) Campaign(serviceName string, candidate ServiceInfo) (LeaderHandle, error) {
+	session, err := concurrency.NewSession(self.client, concurrency.WithTTL(leaderElectionTTL))
+	if err != nil {
+		log.Errorf("Error creating election session for %s, Err: %v", serviceName, err)
+		return nil, err
+	}
+
+	election := concurrency.NewElection(session, "/contiv.io/leader/"+serviceName)
+
+	jsonVal, err := json.Marshal(candidate)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := election.Campaign(context.Background(), string(jsonVal)); err != nil {
+		log.Errorf("Error campaigning for %s leadership, Err: %v", serviceName, err)
+		session.Close()
+		return nil, err
+	}
+
+	log.Infof("%+v is now leader for %s", candidate, serviceName)
+
+	handle := &etcdLeaderHandle{
+		leaderState: newLeaderState(),
+		session:     session,
+		election:    election,
+	}
+
+	go func() {
+		<-session.Done()
+		handle.lost()
+	}()
+
+	return handle, nil
+}
+
+// ObserveLeader streams the current leader's ServiceInfo on ch every
+// time leadership changes for serviceName, until stop fires.
+func (self *etcdPlugin) ObserveLeader(serviceName string, ch chan<- ServiceInfo, stop chan bool) error {
+	session, err := concurrency.NewSession(self.client)
+	if err != nil {
+		log.Errorf("Error creating observe session for %s, Err: %v", serviceName, err)
+		return err
+	}
+
+	election := concurrency.NewElection(session, "/contiv.io/leader/"+serviceName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		if stopReq := <-stop; stopReq {
+			cancel()
+		}
+	}()
+
+	respCh := election.Observe(ctx)
+
+	go func() {
+		defer session.Close()
+
+		for {
+			select {
+			case resp, ok := <-respCh:
+				if !ok {
+					return
+				}
+
+				if len(resp.Kvs) == 0 {
+					continue
+				}
+
+				var leader ServiceInfo
+				if err := json.Unmarshal(resp.Kvs[0].Value, &leader); err != nil {
+					log.Errorf("Error parsing leader value for %s, Err %v", serviceName, err)
+					continue
+				}
+
+				ch <- leader
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
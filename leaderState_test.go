@@ -0,0 +1,107 @@
+package objdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaderStateResignClosesLostCh(t *testing.T) {
+	state := newLeaderState()
+
+	if !state.IsLeader() {
+		t.Fatalf("expected new leaderState to report IsLeader")
+	}
+
+	teardownCalled := false
+	if err := state.resign(func() error {
+		teardownCalled = true
+		return nil
+	}); err != nil {
+		t.Fatalf("resign failed: %v", err)
+	}
+
+	if !teardownCalled {
+		t.Fatalf("expected resign to run teardown")
+	}
+
+	if state.IsLeader() {
+		t.Fatalf("expected IsLeader to be false after resign")
+	}
+
+	select {
+	case <-state.LostCh():
+	default:
+		t.Fatalf("expected LostCh to be closed after resign")
+	}
+}
+
+func TestLeaderStateResignPropagatesTeardownError(t *testing.T) {
+	state := newLeaderState()
+
+	wantErr := errors.New("teardown failed")
+	if err := state.resign(func() error { return wantErr }); err != wantErr {
+		t.Fatalf("resign returned %v, want %v", err, wantErr)
+	}
+
+	select {
+	case <-state.LostCh():
+	default:
+		t.Fatalf("expected LostCh to be closed even when teardown errors")
+	}
+}
+
+func TestLeaderStateResignIsIdempotent(t *testing.T) {
+	state := newLeaderState()
+
+	calls := 0
+	teardown := func() error {
+		calls++
+		return nil
+	}
+
+	if err := state.resign(teardown); err != nil {
+		t.Fatalf("first resign failed: %v", err)
+	}
+	if err := state.resign(teardown); err != nil {
+		t.Fatalf("second resign failed: %v", err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected teardown to run once, ran %d times", calls)
+	}
+}
+
+func TestLeaderStateLostClosesLostCh(t *testing.T) {
+	state := newLeaderState()
+
+	state.lost()
+
+	if state.IsLeader() {
+		t.Fatalf("expected IsLeader to be false after lost")
+	}
+
+	select {
+	case <-state.LostCh():
+	default:
+		t.Fatalf("expected LostCh to be closed after lost")
+	}
+}
+
+func TestLeaderStateResignAfterLostDoesNotDoubleClose(t *testing.T) {
+	state := newLeaderState()
+
+	state.lost()
+
+	done := make(chan error, 1)
+	go func() { done <- state.resign(func() error { return nil }) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("resign after lost returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("resign after lost did not return")
+	}
+}
@@ -0,0 +1,174 @@
+package objdb
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ResolverPolicy selects which endpoint Pick returns from a
+// ServiceResolver's current healthy set.
+type ResolverPolicy int
+
+const (
+	// ResolverRoundRobin cycles through endpoints in order.
+	ResolverRoundRobin ResolverPolicy = iota
+	// ResolverRandom picks a uniformly random endpoint.
+	ResolverRandom
+	// ResolverLeastRecentlyUsed picks the endpoint Pick returned least
+	// recently (or never).
+	ResolverLeastRecentlyUsed
+)
+
+// ServiceResolver subscribes once to WatchService and maintains a live,
+// thread-safe slice of healthy ServiceInfo endpoints for a named
+// service. Pick turns that into a client-side load-balancing primitive,
+// so netmaster/netplugin components can talk to peers directly instead
+// of through an external proxy.
+type ServiceResolver struct {
+	client      Client
+	serviceName string
+	policy      ResolverPolicy
+
+	lock      sync.Mutex
+	endpoints []ServiceInfo
+	lastUsed  map[string]int64
+	rrNext    int
+	seq       int64
+
+	eventCh chan WatchServiceEvent
+	stopCh  chan bool
+	doneCh  chan struct{}
+}
+
+// NewServiceResolver builds a ServiceResolver for serviceName backed by
+// client, and starts its watch subscription. The resilient
+// reconnect/resync behavior of WatchService is what keeps the resolver
+// correct across watch errors; the resolver itself only reacts to the
+// Add/Del events it receives.
+func NewServiceResolver(client Client, serviceName string, policy ResolverPolicy) (*ServiceResolver, error) {
+	resolver := &ServiceResolver{
+		client:      client,
+		serviceName: serviceName,
+		policy:      policy,
+		lastUsed:    make(map[string]int64),
+		eventCh:     make(chan WatchServiceEvent, 64),
+		stopCh:      make(chan bool, 1),
+		doneCh:      make(chan struct{}),
+	}
+
+	if err := client.WatchService(serviceName, resolver.eventCh, resolver.stopCh); err != nil {
+		return nil, err
+	}
+
+	go resolver.run()
+
+	return resolver, nil
+}
+
+// Stop ends the watch subscription and the resolver's event loop.
+func (r *ServiceResolver) Stop() {
+	r.stopCh <- true
+	close(r.doneCh)
+}
+
+// Pick returns a healthy endpoint for the resolver's service, chosen
+// according to its policy.
+func (r *ServiceResolver) Pick() (ServiceInfo, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.endpoints) == 0 {
+		return ServiceInfo{}, errors.New("no healthy endpoints for service " + r.serviceName)
+	}
+
+	switch r.policy {
+	case ResolverRandom:
+		return r.endpoints[rand.Intn(len(r.endpoints))], nil
+	case ResolverLeastRecentlyUsed:
+		return r.pickLeastRecentlyUsedLocked(), nil
+	default:
+		return r.pickRoundRobinLocked(), nil
+	}
+}
+
+func (r *ServiceResolver) pickRoundRobinLocked() ServiceInfo {
+	endpoint := r.endpoints[r.rrNext%len(r.endpoints)]
+	r.rrNext++
+
+	return endpoint
+}
+
+func (r *ServiceResolver) pickLeastRecentlyUsedLocked() ServiceInfo {
+	oldest := r.endpoints[0]
+	oldestUsed := r.lastUsed[endpointKey(oldest)]
+
+	for _, endpoint := range r.endpoints[1:] {
+		if used := r.lastUsed[endpointKey(endpoint)]; used < oldestUsed {
+			oldest = endpoint
+			oldestUsed = used
+		}
+	}
+
+	r.seq++
+	r.lastUsed[endpointKey(oldest)] = r.seq
+
+	return oldest
+}
+
+// run applies Add/Del events to the resolver's endpoint set until Stop
+// is called.
+func (r *ServiceResolver) run() {
+	for {
+		select {
+		case event := <-r.eventCh:
+			switch event.EventType {
+			case WatchServiceEventAdd:
+				r.addEndpoint(event.ServiceInfo)
+			case WatchServiceEventDel:
+				r.removeEndpoint(event.ServiceInfo)
+			case WatchServiceEventError:
+				log.Errorf("Service resolver for %s saw a watch error", r.serviceName)
+			}
+		case <-r.doneCh:
+			return
+		}
+	}
+}
+
+func (r *ServiceResolver) addEndpoint(endpoint ServiceInfo) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := endpointKey(endpoint)
+	for i, existing := range r.endpoints {
+		if endpointKey(existing) == key {
+			r.endpoints[i] = endpoint
+			return
+		}
+	}
+
+	r.endpoints = append(r.endpoints, endpoint)
+}
+
+func (r *ServiceResolver) removeEndpoint(endpoint ServiceInfo) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := endpointKey(endpoint)
+	delete(r.lastUsed, key)
+
+	for i, existing := range r.endpoints {
+		if endpointKey(existing) == key {
+			r.endpoints = append(r.endpoints[:i], r.endpoints[i+1:]...)
+			return
+		}
+	}
+}
+
+func endpointKey(endpoint ServiceInfo) string {
+	return endpoint.HostAddr + ":" + strconv.Itoa(endpoint.Port)
+}
@@ -0,0 +1,187 @@
+package objdb
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeClient is a minimal Client that only wires up WatchService, for
+// tests that drive a ServiceResolver directly without an etcd or consul
+// backend.
+type fakeClient struct {
+	eventCh chan WatchServiceEvent
+	stopCh  chan bool
+}
+
+func (f *fakeClient) RegisterService(ServiceInfo) error { return nil }
+func (f *fakeClient) RegisterServiceWithContext(context.Context, ServiceInfo) error {
+	return nil
+}
+func (f *fakeClient) DeregisterService(ServiceInfo) error { return nil }
+func (f *fakeClient) DeregisterServiceWithContext(context.Context, ServiceInfo) error {
+	return nil
+}
+func (f *fakeClient) GetService(string) ([]ServiceInfo, error) { return nil, nil }
+func (f *fakeClient) GetServiceWithContext(context.Context, string) ([]ServiceInfo, error) {
+	return nil, nil
+}
+func (f *fakeClient) WatchService(name string, eventCh chan WatchServiceEvent, stopCh chan bool) error {
+	f.eventCh = eventCh
+	f.stopCh = stopCh
+	return nil
+}
+func (f *fakeClient) WatchServiceWithContext(context.Context, string, chan WatchServiceEvent) error {
+	return nil
+}
+func (f *fakeClient) Campaign(string, ServiceInfo) (LeaderHandle, error) { return nil, nil }
+func (f *fakeClient) ObserveLeader(string, chan<- ServiceInfo, chan bool) error {
+	return nil
+}
+
+// waitForEndpointCount polls the resolver's internal endpoint set until
+// it reaches n, failing the test if that doesn't happen in time. run()
+// applies events on its own goroutine, so tests need to synchronize on
+// its effect rather than the send.
+func waitForEndpointCount(t *testing.T, r *ServiceResolver, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		r.lock.Lock()
+		count := len(r.endpoints)
+		r.lock.Unlock()
+
+		if count == n {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for %d endpoints to be applied", n)
+}
+
+func newTestResolver(t *testing.T, policy ResolverPolicy, endpoints ...ServiceInfo) (*ServiceResolver, *fakeClient) {
+	t.Helper()
+
+	fc := &fakeClient{}
+
+	resolver, err := NewServiceResolver(fc, "test-svc", policy)
+	if err != nil {
+		t.Fatalf("NewServiceResolver failed: %v", err)
+	}
+
+	for _, ep := range endpoints {
+		fc.eventCh <- WatchServiceEvent{EventType: WatchServiceEventAdd, ServiceInfo: ep}
+	}
+
+	waitForEndpointCount(t, resolver, len(endpoints))
+
+	return resolver, fc
+}
+
+func TestServiceResolverPickNoEndpoints(t *testing.T) {
+	fc := &fakeClient{}
+
+	resolver, err := NewServiceResolver(fc, "test-svc", ResolverRoundRobin)
+	if err != nil {
+		t.Fatalf("NewServiceResolver failed: %v", err)
+	}
+	defer resolver.Stop()
+
+	if _, err := resolver.Pick(); err == nil {
+		t.Fatalf("expected Pick to error with no endpoints")
+	}
+}
+
+func TestServiceResolverRoundRobin(t *testing.T) {
+	eps := []ServiceInfo{
+		{ServiceName: "test-svc", HostAddr: "10.0.0.1", Port: 1},
+		{ServiceName: "test-svc", HostAddr: "10.0.0.2", Port: 2},
+	}
+
+	resolver, _ := newTestResolver(t, ResolverRoundRobin, eps...)
+	defer resolver.Stop()
+
+	for i := 0; i < 4; i++ {
+		got, err := resolver.Pick()
+		if err != nil {
+			t.Fatalf("Pick failed: %v", err)
+		}
+
+		if want := eps[i%len(eps)]; got != want {
+			t.Fatalf("Pick #%d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestServiceResolverRandom(t *testing.T) {
+	eps := []ServiceInfo{
+		{ServiceName: "test-svc", HostAddr: "10.0.0.1", Port: 1},
+		{ServiceName: "test-svc", HostAddr: "10.0.0.2", Port: 2},
+	}
+	valid := map[ServiceInfo]bool{eps[0]: true, eps[1]: true}
+
+	resolver, _ := newTestResolver(t, ResolverRandom, eps...)
+	defer resolver.Stop()
+
+	for i := 0; i < 20; i++ {
+		got, err := resolver.Pick()
+		if err != nil {
+			t.Fatalf("Pick failed: %v", err)
+		}
+
+		if !valid[got] {
+			t.Fatalf("Pick returned unknown endpoint %+v", got)
+		}
+	}
+}
+
+func TestServiceResolverLeastRecentlyUsed(t *testing.T) {
+	eps := []ServiceInfo{
+		{ServiceName: "test-svc", HostAddr: "10.0.0.1", Port: 1},
+		{ServiceName: "test-svc", HostAddr: "10.0.0.2", Port: 2},
+		{ServiceName: "test-svc", HostAddr: "10.0.0.3", Port: 3},
+	}
+
+	resolver, _ := newTestResolver(t, ResolverLeastRecentlyUsed, eps...)
+	defer resolver.Stop()
+
+	// With no picks yet, every endpoint is equally stale, so it cycles
+	// through them in order, then wraps back around.
+	want := []ServiceInfo{eps[0], eps[1], eps[2], eps[0]}
+	for i, w := range want {
+		got, err := resolver.Pick()
+		if err != nil {
+			t.Fatalf("Pick failed: %v", err)
+		}
+
+		if got != w {
+			t.Fatalf("Pick #%d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestServiceResolverRemovesDeletedEndpoint(t *testing.T) {
+	eps := []ServiceInfo{
+		{ServiceName: "test-svc", HostAddr: "10.0.0.1", Port: 1},
+		{ServiceName: "test-svc", HostAddr: "10.0.0.2", Port: 2},
+	}
+
+	resolver, fc := newTestResolver(t, ResolverRoundRobin, eps...)
+	defer resolver.Stop()
+
+	fc.eventCh <- WatchServiceEvent{EventType: WatchServiceEventDel, ServiceInfo: eps[0]}
+	waitForEndpointCount(t, resolver, 1)
+
+	got, err := resolver.Pick()
+	if err != nil {
+		t.Fatalf("Pick failed: %v", err)
+	}
+
+	if got != eps[1] {
+		t.Fatalf("Pick = %+v, want %+v", got, eps[1])
+	}
+}